@@ -0,0 +1,543 @@
+//
+// Copyright (c) 2018-2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	kernelCmdlineFile = "/proc/cmdline"
+
+	// defaultAgentConfigFile is the optional system-wide config file that
+	// sits below the kernel command line and above the built-in defaults
+	// in the precedence order.
+	defaultAgentConfigFile = "/etc/kata-containers/agent.toml"
+
+	// envVarPrefix is the namespace all agent environment variables live
+	// under. Any KATA_AGENT_* variable takes precedence over both the
+	// kernel command line and the config file.
+	envVarPrefix = "KATA_AGENT_"
+
+	optionPrefix = "agent."
+
+	logLevelFlag     = optionPrefix + "log"
+	debugFlag        = optionPrefix + "debug"
+	devModeFlag      = optionPrefix + "devmode"
+	crashOnErrorFlag = optionPrefix + "crash_on_error"
+	traceModeFlag    = optionPrefix + "trace"
+
+	traceValueIsolated = "isolated"
+	traceValueCollated = "collated"
+)
+
+var (
+	debug         = false
+	tracing       = false
+	collatedTrace = false
+	crashOnError  = false
+
+	// currentTrace is the most recently applied trace configuration.
+	// tracing/collatedTrace remain the quick booleans most of the agent
+	// reads; currentTrace is there for a tracing backend that needs the
+	// full detail (sampler, exporter, endpoint, ...).
+	currentTrace *TraceConfig
+)
+
+// TraceConfig is the parsed form of agent.trace's sub-option grammar,
+// e.g. agent.trace=mode=collated,sampler=parent,exporter=otlp,endpoint=vsock://2:4317,ratio=0.1.
+// traceValueIsolated/traceValueCollated on their own remain valid shorthand
+// for mode=isolated/mode=collated.
+type TraceConfig struct {
+	Mode        string
+	Sampler     string
+	Exporter    string
+	Endpoint    string
+	Ratio       float64
+	Propagators []string
+}
+
+// agentConfig is the config derived by merging the agent config file, the
+// kernel command line and the agent environment variables, in that
+// ascending order of precedence.
+type agentConfig struct {
+	logLevel logrus.Level
+
+	// fs is the filesystem config loading reads through. It defaults to
+	// the real filesystem (osFS{}); tests substitute an in-memory FS via
+	// WithFS so they never have to touch disk.
+	fs FS
+}
+
+// Config is a single layer of agent configuration. Every field is a
+// pointer so that an unset value can be distinguished from an explicit
+// "false"/zero value: MergeConfig only overwrites a destination field
+// when the source field is non-nil, which is what lets a lower-precedence
+// layer supply a value without being clobbered by a higher-precedence
+// layer that simply didn't mention it.
+type Config struct {
+	LogLevel      *logrus.Level
+	Debug         *bool
+	Tracing       *bool
+	CollatedTrace *bool
+	CrashOnError  *bool
+	DevMode       *bool
+	Trace         *TraceConfig
+}
+
+// defaultConfig returns the lowest-precedence layer: the agent's built-in
+// defaults.
+func defaultConfig() *Config {
+	level := logrus.InfoLevel
+
+	return &Config{
+		LogLevel: &level,
+	}
+}
+
+// MergeConfig merges src into dst, field by field. A nil field in src
+// leaves the corresponding dst field untouched; a non-nil field in src
+// always wins. dst is modified in place; src is never modified.
+func MergeConfig(dst, src *Config) {
+	if dst == nil || src == nil {
+		return
+	}
+
+	if src.LogLevel != nil {
+		dst.LogLevel = src.LogLevel
+	}
+
+	if src.Debug != nil {
+		dst.Debug = src.Debug
+	}
+
+	if src.Tracing != nil {
+		dst.Tracing = src.Tracing
+	}
+
+	if src.CollatedTrace != nil {
+		dst.CollatedTrace = src.CollatedTrace
+	}
+
+	if src.CrashOnError != nil {
+		dst.CrashOnError = src.CrashOnError
+	}
+
+	if src.DevMode != nil {
+		dst.DevMode = src.DevMode
+	}
+
+	if src.Trace != nil {
+		dst.Trace = src.Trace
+	}
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
+
+func newConfig(logLevel logrus.Level) agentConfig {
+	return agentConfig{
+		logLevel: logLevel,
+	}
+}
+
+// WithFS sets the filesystem c loads its config through and returns c,
+// so it can be chained onto construction (e.g. (&agentConfig{}).WithFS(fs)).
+// Callers that never call WithFS get the real filesystem, via osFS{}.
+func (c *agentConfig) WithFS(fs FS) *agentConfig {
+	c.fs = fs
+	return c
+}
+
+func (c *agentConfig) fileSystem() FS {
+	if c.fs == nil {
+		return osFS{}
+	}
+
+	return c.fs
+}
+
+// applyConfig applies a fully-merged Config to c, updating the package
+// level state (debug, tracing, collatedTrace, crashOnError, currentTrace)
+// that the rest of the agent reads directly. It is a total function of
+// cfg: every field it derives is assigned outright rather than only
+// raised, so calling it twice with different merged configs (as a config
+// reload does) leaves no stale state behind from the previous call.
+func (c *agentConfig) applyConfig(cfg *Config) {
+	if cfg == nil {
+		return
+	}
+
+	if cfg.LogLevel != nil {
+		c.logLevel = *cfg.LogLevel
+	}
+
+	devMode := cfg.DevMode != nil && *cfg.DevMode
+
+	crashOnError = devMode
+	if cfg.CrashOnError != nil {
+		crashOnError = *cfg.CrashOnError
+	}
+
+	collatedTrace = cfg.CollatedTrace != nil && *cfg.CollatedTrace
+
+	tracing = collatedTrace
+	if cfg.Tracing != nil {
+		tracing = *cfg.Tracing
+	}
+
+	debug = devMode
+	if cfg.Debug != nil {
+		debug = *cfg.Debug
+	}
+
+	currentTrace = cfg.Trace
+
+	if tracing || collatedTrace || c.logLevel == logrus.DebugLevel {
+		debug = true
+	}
+}
+
+// parseOneCmdlineOption parses a single kernel command line token,
+// recording any agent-related setting it represents in cfg. Tokens that
+// aren't meant for the agent (the kernel command line is shared with
+// every other consumer) are silently ignored; a token that looks like an
+// agent option but isn't recognised is an error.
+func parseOneCmdlineOption(option string, cfg *Config) error {
+	split := strings.SplitN(option, "=", 2)
+
+	switch split[0] {
+	case devModeFlag:
+		cfg.DevMode = boolPtr(true)
+
+	case debugFlag:
+		if len(split) != 2 {
+			cfg.Debug = boolPtr(true)
+			return nil
+		}
+
+		value, err := strconv.ParseBool(split[1])
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %v", debugFlag, err)
+		}
+
+		cfg.Debug = &value
+
+	case crashOnErrorFlag:
+		if len(split) != 2 {
+			cfg.CrashOnError = boolPtr(true)
+			return nil
+		}
+
+		value, err := strconv.ParseBool(split[1])
+		if err != nil {
+			return fmt.Errorf("invalid value for %s: %v", crashOnErrorFlag, err)
+		}
+
+		cfg.CrashOnError = &value
+
+	case logLevelFlag:
+		if len(split) != 2 {
+			return fmt.Errorf("%s requires a value", logLevelFlag)
+		}
+
+		level, err := logrus.ParseLevel(split[1])
+		if err != nil {
+			return err
+		}
+
+		cfg.LogLevel = &level
+
+	case traceModeFlag:
+		switch len(split) {
+		case 1:
+			cfg.Tracing = boolPtr(true)
+			cfg.CollatedTrace = boolPtr(false)
+			cfg.Trace = &TraceConfig{Mode: traceValueIsolated}
+
+		case 2:
+			tc, err := parseTraceConfig(split[1])
+			if err != nil {
+				return err
+			}
+
+			cfg.Trace = tc
+			cfg.Tracing = boolPtr(true)
+			cfg.CollatedTrace = boolPtr(tc.Mode == traceValueCollated)
+
+		default:
+			return fmt.Errorf("invalid %s option %q", traceModeFlag, option)
+		}
+
+	default:
+		if len(split) == 2 && strings.HasPrefix(split[0], optionPrefix) {
+			return fmt.Errorf("unknown option %q", split[0])
+		}
+	}
+
+	return nil
+}
+
+// parseTraceConfig parses the value half of agent.trace=<value>: either
+// one of the traceValueIsolated/traceValueCollated shorthands, or a
+// comma-separated key=value list (mode=collated,sampler=parent,...). A
+// value may be double-quoted to protect commas it contains (e.g.
+// propagators="b3,tracecontext") from being treated as sub-option
+// separators.
+func parseTraceConfig(value string) (*TraceConfig, error) {
+	switch value {
+	case traceValueIsolated, traceValueCollated:
+		return &TraceConfig{Mode: value}, nil
+	}
+
+	fields, err := splitTraceOptions(value)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &TraceConfig{}
+
+	for _, field := range fields {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid %s sub-option %q", traceModeFlag, field)
+		}
+
+		key, val := kv[0], kv[1]
+
+		switch key {
+		case "mode":
+			tc.Mode = val
+		case "sampler":
+			tc.Sampler = val
+		case "exporter":
+			tc.Exporter = val
+		case "endpoint":
+			tc.Endpoint = val
+		case "ratio":
+			ratio, err := strconv.ParseFloat(val, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s ratio %q: %v", traceModeFlag, val, err)
+			}
+			tc.Ratio = ratio
+		case "propagators":
+			tc.Propagators = strings.Split(val, ",")
+		default:
+			return nil, fmt.Errorf("unknown %s sub-option %q", traceModeFlag, key)
+		}
+	}
+
+	if tc.Mode != traceValueIsolated && tc.Mode != traceValueCollated {
+		return nil, fmt.Errorf("%s requires mode=%s or mode=%s", traceModeFlag, traceValueIsolated, traceValueCollated)
+	}
+
+	return tc, nil
+}
+
+// splitTraceOptions splits s on commas, except for commas inside a
+// double-quoted value, so a sub-option like propagators="b3,tracecontext"
+// survives as a single field.
+func splitTraceOptions(s string) ([]string, error) {
+	var fields []string
+	var buf strings.Builder
+	inQuotes := false
+
+	for i := 0; i < len(s); i++ {
+		switch ch := s[i]; {
+		case ch == '"':
+			inQuotes = !inQuotes
+		case ch == ',' && !inQuotes:
+			fields = append(fields, buf.String())
+			buf.Reset()
+		default:
+			buf.WriteByte(ch)
+		}
+	}
+
+	if inQuotes {
+		return nil, fmt.Errorf("unterminated quote in %s value %q", traceModeFlag, s)
+	}
+
+	fields = append(fields, buf.String())
+
+	return fields, nil
+}
+
+// parseCmdlineOption parses a single option and applies it immediately.
+// It exists alongside buildCmdlineConfig for callers that only have one
+// option to hand (rather than a whole command line to merge).
+func (c *agentConfig) parseCmdlineOption(option string) error {
+	cfg := &Config{}
+
+	if err := parseOneCmdlineOption(option, cfg); err != nil {
+		return err
+	}
+
+	c.applyConfig(cfg)
+
+	return nil
+}
+
+// buildCmdlineConfig parses every whitespace-separated token in data,
+// merging them into a single Config layer. Tokens that don't parse are
+// silently skipped rather than failing the whole layer: the kernel
+// command line is shared with many other consumers and the agent only
+// owns the "agent.*" namespace.
+func buildCmdlineConfig(data string) *Config {
+	cfg := &Config{}
+
+	for _, option := range strings.Fields(data) {
+		optCfg := &Config{}
+
+		if err := parseOneCmdlineOption(option, optCfg); err != nil {
+			continue
+		}
+
+		MergeConfig(cfg, optCfg)
+	}
+
+	return cfg
+}
+
+// fileConfig mirrors Config but with TOML tags, matching the on-disk
+// shape of defaultAgentConfigFile.
+type fileConfig struct {
+	LogLevel      string `toml:"log_level"`
+	Debug         *bool  `toml:"debug"`
+	Tracing       *bool  `toml:"tracing"`
+	CollatedTrace *bool  `toml:"collated_trace"`
+	CrashOnError  *bool  `toml:"crash_on_error"`
+	DevMode       *bool  `toml:"devmode"`
+}
+
+// loadConfigFile reads and parses the agent's optional TOML config file
+// through fs. A missing file is reported as an error so callers can
+// choose to ignore it; any other failure (bad syntax, bad log level) is
+// returned as-is.
+func loadConfigFile(fs FS, path string) (*Config, error) {
+	data, err := fs.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fc fileConfig
+	if _, err := toml.Decode(string(data), &fc); err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{
+		Debug:         fc.Debug,
+		Tracing:       fc.Tracing,
+		CollatedTrace: fc.CollatedTrace,
+		CrashOnError:  fc.CrashOnError,
+		DevMode:       fc.DevMode,
+	}
+
+	if fc.LogLevel != "" {
+		level, err := logrus.ParseLevel(fc.LogLevel)
+		if err != nil {
+			return nil, fmt.Errorf("invalid log_level in %s: %v", path, err)
+		}
+
+		cfg.LogLevel = &level
+	}
+
+	return cfg, nil
+}
+
+// buildEnvConfig parses KATA_AGENT_* entries out of environ (the format
+// returned by os.Environ()) into a Config layer. Unknown KATA_AGENT_*
+// variables and values that fail to parse are ignored rather than
+// erroring, since this layer runs unattended as part of every config
+// load.
+func buildEnvConfig(environ []string) *Config {
+	cfg := &Config{}
+
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], envVarPrefix) {
+			continue
+		}
+
+		name, value := parts[0], parts[1]
+
+		switch name {
+		case envVarPrefix + "LOG_LEVEL":
+			if level, err := logrus.ParseLevel(value); err == nil {
+				cfg.LogLevel = &level
+			}
+		case envVarPrefix + "DEBUG":
+			if v, err := strconv.ParseBool(value); err == nil {
+				cfg.Debug = &v
+			}
+		case envVarPrefix + "TRACING":
+			if v, err := strconv.ParseBool(value); err == nil {
+				cfg.Tracing = &v
+			}
+		case envVarPrefix + "COLLATED_TRACE":
+			if v, err := strconv.ParseBool(value); err == nil {
+				cfg.CollatedTrace = &v
+			}
+		case envVarPrefix + "CRASH_ON_ERROR":
+			if v, err := strconv.ParseBool(value); err == nil {
+				cfg.CrashOnError = &v
+			}
+		case envVarPrefix + "DEVMODE":
+			if v, err := strconv.ParseBool(value); err == nil {
+				cfg.DevMode = &v
+			}
+		}
+	}
+
+	return cfg
+}
+
+// getConfig builds the agent's configuration by merging, in ascending
+// order of precedence, the built-in defaults, the optional
+// defaultAgentConfigFile, the kernel command line (read from
+// cmdlineFile) and the process environment: env > cmdline > file >
+// defaults.
+func (c *agentConfig) getConfig(cmdlineFile string) error {
+	if cmdlineFile == "" {
+		return fmt.Errorf("kernel command line file cannot be empty")
+	}
+
+	fs := c.fileSystem()
+
+	data, err := fs.ReadFile(cmdlineFile)
+	if err != nil {
+		return err
+	}
+
+	merged := defaultConfig()
+
+	if fileCfg, err := loadConfigFile(fs, defaultAgentConfigFile); err == nil {
+		MergeConfig(merged, fileCfg)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	MergeConfig(merged, buildCmdlineConfig(string(data)))
+	MergeConfig(merged, buildEnvConfig(os.Environ()))
+
+	c.applyConfig(merged)
+
+	return nil
+}
+
+func enableTracing(collated bool) {
+	tracing = true
+	debug = true
+	collatedTrace = collated
+}
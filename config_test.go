@@ -7,10 +7,13 @@
 package main
 
 import (
-	"io/ioutil"
+	"context"
 	"os"
 	"reflect"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -149,35 +152,20 @@ func TestGetConfigEmptyFileName(t *testing.T) {
 func TestGetConfigFilePathNotExist(t *testing.T) {
 	assert := assert.New(t)
 
-	a := &agentConfig{}
-
-	tmpFile, err := ioutil.TempFile("", "test")
-	assert.NoError(err, "%v", err)
-
-	fileName := tmpFile.Name()
-	tmpFile.Close()
-	err = os.Remove(fileName)
-	assert.NoError(err, "%v", err)
+	a := (&agentConfig{}).WithFS(newMemFS(nil))
 
-	err = a.getConfig(fileName)
+	err := a.getConfig("/proc/cmdline")
 	assert.Error(err, "Should fail because command line path does not exist")
 }
 
 func TestGetConfig(t *testing.T) {
 	assert := assert.New(t)
 
-	a := &agentConfig{}
-
-	tmpFile, err := ioutil.TempFile("", "test")
-	assert.NoError(err, "%v", err)
-	fileName := tmpFile.Name()
-
-	tmpFile.Write([]byte(logLevelFlag + "=info"))
-	tmpFile.Close()
-
-	defer os.Remove(fileName)
+	a := (&agentConfig{}).WithFS(newMemFS(map[string]string{
+		"/proc/cmdline": logLevelFlag + "=info",
+	}))
 
-	err = a.getConfig(fileName)
+	err := a.getConfig("/proc/cmdline")
 	assert.NoError(err, "%v", err)
 
 	assert.True(a.logLevel == logrus.InfoLevel,
@@ -211,6 +199,14 @@ func TestParseCmdlineOptionTracing(t *testing.T) {
 
 		{traceModeFlag + "=" + traceValueIsolated + "x", false, false},
 		{traceModeFlag + "=" + traceValueCollated + "x", false, false},
+
+		// structured sub-option grammar
+		{traceModeFlag + "=mode=isolated,sampler=parent,exporter=otlp,endpoint=vsock://2:4317,ratio=0.1", true, false},
+		{traceModeFlag + "=mode=collated,sampler=parent", true, true},
+		{traceModeFlag + "=mode=bogus", false, false},           // unsupported mode
+		{traceModeFlag + "=mode=isolated,bogus=1", false, false}, // unknown sub-key
+		{traceModeFlag + "=mode=isolated,sampler", false, false}, // malformed sub-key (no "=")
+		{traceModeFlag + "=mode=isolated,mode=collated", true, true}, // duplicate key, last wins
 	}
 
 	for i, d := range data {
@@ -219,22 +215,15 @@ func TestParseCmdlineOptionTracing(t *testing.T) {
 		collatedTrace = false
 		debug = false
 
-		a := &agentConfig{}
-
-		tmpFile, err := ioutil.TempFile("", "")
-		assert.NoError(err)
-
-		fileName := tmpFile.Name()
-		defer os.Remove(fileName)
-
-		tmpFile.Write([]byte(d.option))
-		tmpFile.Close()
+		a := (&agentConfig{}).WithFS(newMemFS(map[string]string{
+			"/proc/cmdline": d.option,
+		}))
 
 		assert.False(tracing)
 		assert.False(collatedTrace)
 		assert.False(debug)
 
-		err = a.getConfig(fileName)
+		err := a.getConfig("/proc/cmdline")
 		assert.NoError(err)
 
 		if d.expectTraceEnabled {
@@ -255,6 +244,76 @@ func TestParseCmdlineOptionTracing(t *testing.T) {
 	}
 }
 
+func TestBuildCmdlineConfigTraceLastTokenWins(t *testing.T) {
+	assert := assert.New(t)
+
+	// Two agent.trace tokens on one cmdline must agree on CollatedTrace
+	// and Trace.Mode: whichever comes last wins for both.
+	cfg := buildCmdlineConfig(traceModeFlag + "=" + traceValueCollated + " " + traceModeFlag + "=" + traceValueIsolated)
+	assert.Equal(traceValueIsolated, cfg.Trace.Mode)
+	assert.False(*cfg.CollatedTrace)
+
+	cfg = buildCmdlineConfig(traceModeFlag + "=" + traceValueIsolated + " " + traceModeFlag + "=" + traceValueCollated)
+	assert.Equal(traceValueCollated, cfg.Trace.Mode)
+	assert.True(*cfg.CollatedTrace)
+}
+
+func TestParseTraceConfigShorthands(t *testing.T) {
+	assert := assert.New(t)
+
+	tc, err := parseTraceConfig(traceValueIsolated)
+	assert.NoError(err)
+	assert.Equal(traceValueIsolated, tc.Mode)
+
+	tc, err = parseTraceConfig(traceValueCollated)
+	assert.NoError(err)
+	assert.Equal(traceValueCollated, tc.Mode)
+}
+
+func TestParseTraceConfigSubOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	tc, err := parseTraceConfig("mode=isolated,sampler=parent,exporter=otlp,endpoint=vsock://2:4317,ratio=0.1")
+	assert.NoError(err)
+	assert.Equal("isolated", tc.Mode)
+	assert.Equal("parent", tc.Sampler)
+	assert.Equal("otlp", tc.Exporter)
+	assert.Equal("vsock://2:4317", tc.Endpoint)
+	assert.Equal(0.1, tc.Ratio)
+}
+
+func TestParseTraceConfigDuplicateKeyLastWins(t *testing.T) {
+	assert := assert.New(t)
+
+	tc, err := parseTraceConfig("mode=isolated,mode=collated")
+	assert.NoError(err)
+	assert.Equal("collated", tc.Mode)
+}
+
+func TestParseTraceConfigQuotedValueWithCommas(t *testing.T) {
+	assert := assert.New(t)
+
+	tc, err := parseTraceConfig(`mode=isolated,propagators="b3,tracecontext"`)
+	assert.NoError(err)
+	assert.Equal([]string{"b3", "tracecontext"}, tc.Propagators)
+}
+
+func TestParseTraceConfigErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := parseTraceConfig("mode=bogus")
+	assert.Error(err, "unsupported mode must be rejected")
+
+	_, err = parseTraceConfig("mode=isolated,bogus=1")
+	assert.Error(err, "unknown sub-option must be rejected")
+
+	_, err = parseTraceConfig("mode=isolated,sampler")
+	assert.Error(err, "a sub-option without a value must be rejected")
+
+	_, err = parseTraceConfig(`mode=isolated,endpoint="unterminated`)
+	assert.Error(err, "an unterminated quote must be rejected")
+}
+
 func TestEnableTracing(t *testing.T) {
 	assert := assert.New(t)
 
@@ -285,3 +344,288 @@ func TestEnableTracing(t *testing.T) {
 		}
 	}
 }
+
+func TestDefaultConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := defaultConfig()
+
+	assert.NotNil(cfg.LogLevel)
+	assert.Equal(logrus.InfoLevel, *cfg.LogLevel)
+
+	assert.Nil(cfg.Debug)
+	assert.Nil(cfg.Tracing)
+	assert.Nil(cfg.CollatedTrace)
+	assert.Nil(cfg.CrashOnError)
+	assert.Nil(cfg.DevMode)
+}
+
+func TestMergeConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	infoLevel := logrus.InfoLevel
+	debugLevel := logrus.DebugLevel
+
+	// an unset field in src must not clobber an already-set dst field
+	dst := &Config{LogLevel: &infoLevel, Debug: boolPtr(true)}
+	MergeConfig(dst, &Config{})
+	assert.Equal(infoLevel, *dst.LogLevel)
+	assert.True(*dst.Debug)
+
+	// a set field in src always wins, regardless of what dst already has
+	dst = &Config{LogLevel: &infoLevel}
+	MergeConfig(dst, &Config{LogLevel: &debugLevel})
+	assert.Equal(debugLevel, *dst.LogLevel)
+
+	// nil dst or src is a no-op, not a panic
+	assert.NotPanics(func() { MergeConfig(nil, &Config{}) })
+	assert.NotPanics(func() { MergeConfig(&Config{}, nil) })
+
+	// merging three layers applies them in call order, last call wins
+	dst = defaultConfig()
+	MergeConfig(dst, &Config{Debug: boolPtr(false)})
+	MergeConfig(dst, &Config{Debug: boolPtr(true)})
+	assert.True(*dst.Debug)
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	assert := assert.New(t)
+
+	fileName := "/etc/kata-containers/agent.toml"
+	fs := newMemFS(map[string]string{
+		fileName: `
+log_level = "warn"
+debug = true
+tracing = true
+collated_trace = false
+`,
+	})
+
+	cfg, err := loadConfigFile(fs, fileName)
+	assert.NoError(err)
+
+	assert.NotNil(cfg.LogLevel)
+	assert.Equal(logrus.WarnLevel, *cfg.LogLevel)
+	assert.NotNil(cfg.Debug)
+	assert.True(*cfg.Debug)
+	assert.NotNil(cfg.Tracing)
+	assert.True(*cfg.Tracing)
+	assert.NotNil(cfg.CollatedTrace)
+	assert.False(*cfg.CollatedTrace)
+	assert.Nil(cfg.CrashOnError)
+}
+
+func TestLoadConfigFileNotExist(t *testing.T) {
+	assert := assert.New(t)
+
+	_, err := loadConfigFile(newMemFS(nil), "/this/path/should/not/exist/agent.toml")
+	assert.Error(err)
+}
+
+func TestLoadConfigFileInvalidLogLevel(t *testing.T) {
+	assert := assert.New(t)
+
+	fileName := "/etc/kata-containers/agent.toml"
+	fs := newMemFS(map[string]string{
+		fileName: `log_level = "not-a-level"`,
+	})
+
+	_, err := loadConfigFile(fs, fileName)
+	assert.Error(err)
+}
+
+func TestBuildEnvConfig(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := buildEnvConfig([]string{
+		"KATA_AGENT_LOG_LEVEL=error",
+		"KATA_AGENT_DEBUG=true",
+		"KATA_AGENT_TRACING=true",
+		"KATA_AGENT_COLLATED_TRACE=true",
+		"KATA_AGENT_CRASH_ON_ERROR=true",
+		"KATA_AGENT_DEVMODE=true",
+		"KATA_AGENT_UNKNOWN=true",
+		"SOME_OTHER_VAR=true",
+		"malformed",
+	})
+
+	assert.NotNil(cfg.LogLevel)
+	assert.Equal(logrus.ErrorLevel, *cfg.LogLevel)
+	assert.True(*cfg.Debug)
+	assert.True(*cfg.Tracing)
+	assert.True(*cfg.CollatedTrace)
+	assert.True(*cfg.CrashOnError)
+	assert.True(*cfg.DevMode)
+}
+
+func TestBuildEnvConfigInvalidValuesIgnored(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := buildEnvConfig([]string{
+		"KATA_AGENT_LOG_LEVEL=not-a-level",
+		"KATA_AGENT_DEBUG=not-a-bool",
+	})
+
+	assert.Nil(cfg.LogLevel)
+	assert.Nil(cfg.Debug)
+}
+
+func TestGetConfigCmdlineArbitraryBytesNeverPanics(t *testing.T) {
+	assert := assert.New(t)
+
+	// Since cmdline content now arrives entirely through the injectable
+	// FS, the parser can be pounded with arbitrary byte sequences
+	// without ever touching disk.
+	inputs := []string{
+		"",
+		"\x00\x01\x02",
+		strings.Repeat("=", 64),
+		strings.Repeat(traceModeFlag+"=", 32),
+		"agent.log=" + strings.Repeat("x", 4096),
+	}
+
+	for _, in := range inputs {
+		a := (&agentConfig{}).WithFS(newMemFS(map[string]string{
+			"/proc/cmdline": in,
+		}))
+
+		assert.NotPanics(func() {
+			_ = a.getConfig("/proc/cmdline")
+		})
+	}
+}
+
+func TestGetConfigEnvOverridesCmdline(t *testing.T) {
+	assert := assert.New(t)
+
+	a := (&agentConfig{}).WithFS(newMemFS(map[string]string{
+		"/proc/cmdline": logLevelFlag + "=info",
+	}))
+
+	os.Setenv("KATA_AGENT_LOG_LEVEL", "error")
+	defer os.Unsetenv("KATA_AGENT_LOG_LEVEL")
+
+	err := a.getConfig("/proc/cmdline")
+	assert.NoError(err)
+
+	assert.Equal(logrus.ErrorLevel, a.logLevel,
+		"an env var must take precedence over the cmdline value")
+}
+
+func TestManifestChanged(t *testing.T) {
+	assert := assert.New(t)
+
+	fs := newMemFS(map[string]string{
+		"/proc/cmdline": "agent.log=info",
+	})
+
+	a := (&agentConfig{}).WithFS(fs)
+
+	m1 := a.buildManifest("/proc/cmdline")
+	m2 := a.buildManifest("/proc/cmdline")
+	assert.False(m1.changed(m2), "identical content must not be reported as changed")
+
+	fs.Set("/proc/cmdline", "agent.log=debug")
+	m3 := a.buildManifest("/proc/cmdline")
+	assert.True(m1.changed(m3))
+}
+
+func TestReloadAppliesChangedFields(t *testing.T) {
+	assert := assert.New(t)
+
+	tracing = false
+	collatedTrace = false
+	debug = false
+	crashOnError = false
+
+	fs := newMemFS(map[string]string{
+		"/proc/cmdline": logLevelFlag + "=info",
+	})
+
+	a := (&agentConfig{}).WithFS(fs)
+	assert.NoError(a.getConfig("/proc/cmdline"))
+	assert.Equal(logrus.InfoLevel, a.logLevel)
+
+	fs.Set("/proc/cmdline", logLevelFlag+"=warn")
+	assert.True(a.reload("/proc/cmdline"))
+	assert.Equal(logrus.WarnLevel, a.logLevel)
+
+	// Nothing changed this time, so reload must report no change.
+	assert.False(a.reload("/proc/cmdline"))
+}
+
+func TestReloadTogglesTracing(t *testing.T) {
+	assert := assert.New(t)
+
+	tracing = false
+	collatedTrace = false
+	debug = false
+	crashOnError = false
+
+	fs := newMemFS(map[string]string{
+		"/proc/cmdline": "",
+	})
+
+	a := (&agentConfig{}).WithFS(fs)
+	assert.NoError(a.getConfig("/proc/cmdline"))
+	assert.False(tracing)
+
+	fs.Set("/proc/cmdline", traceModeFlag+"="+traceValueCollated)
+	assert.True(a.reload("/proc/cmdline"))
+	assert.True(tracing)
+	assert.True(collatedTrace)
+	assert.NotNil(currentTrace)
+	assert.Equal(traceValueCollated, currentTrace.Mode)
+
+	fs.Set("/proc/cmdline", "")
+	assert.True(a.reload("/proc/cmdline"))
+	assert.False(tracing)
+	assert.False(collatedTrace)
+	assert.Nil(currentTrace, "currentTrace must be cleared once tracing is disabled, not left stale")
+}
+
+func TestWatchFiresExactlyOncePerRealChange(t *testing.T) {
+	assert := assert.New(t)
+
+	tracing = false
+	collatedTrace = false
+	debug = false
+	crashOnError = false
+
+	oldInterval := watchInterval
+	watchInterval = 10 * time.Millisecond
+	defer func() { watchInterval = oldInterval }()
+
+	fs := newMemFS(map[string]string{
+		"/proc/cmdline": logLevelFlag + "=info",
+	})
+
+	a := (&agentConfig{}).WithFS(fs)
+	assert.NoError(a.getConfig("/proc/cmdline"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+
+	var calls int32
+
+	done := make(chan error, 1)
+	go func() {
+		done <- a.Watch(ctx, "/proc/cmdline", func(*agentConfig) error {
+			atomic.AddInt32(&calls, 1)
+			return nil
+		})
+	}()
+
+	// Identical rewrites must never trigger onChange.
+	time.Sleep(30 * time.Millisecond)
+	fs.Set("/proc/cmdline", logLevelFlag+"=info")
+	fs.Set("/proc/cmdline", logLevelFlag+"=info")
+
+	// Exactly one real change.
+	time.Sleep(30 * time.Millisecond)
+	fs.Set("/proc/cmdline", logLevelFlag+"=warn")
+
+	assert.NoError(<-done)
+	assert.Equal(int32(1), atomic.LoadInt32(&calls))
+	assert.Equal(logrus.WarnLevel, a.logLevel)
+}
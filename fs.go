@@ -0,0 +1,126 @@
+//
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// FS is the filesystem surface the agent needs for loading its config.
+// Its Open and Stat follow afero.Fs's shape, with ReadFile added. An
+// afero.Fs does not satisfy FS as it stands, since Open here returns this
+// package's File; using one takes a small wrapper.
+type FS interface {
+	Open(name string) (File, error)
+	Stat(name string) (os.FileInfo, error)
+	ReadFile(name string) ([]byte, error)
+}
+
+// File is the subset of os.File (and afero.File) that Open callers need.
+type File interface {
+	io.ReadCloser
+	Stat() (os.FileInfo, error)
+}
+
+// osFS is the default FS, backed by the real filesystem.
+type osFS struct{}
+
+func (osFS) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+// memFS is an in-memory FS, keyed by path. It exists so tests can
+// exercise config loading (including the "file doesn't exist" path)
+// without touching disk.
+type memFS struct {
+	files map[string][]byte
+}
+
+// newMemFS builds a memFS pre-populated with files, keyed by path.
+func newMemFS(files map[string]string) *memFS {
+	m := &memFS{files: make(map[string][]byte, len(files))}
+
+	for name, content := range files {
+		m.files[name] = []byte(content)
+	}
+
+	return m
+}
+
+func (m *memFS) notExist(name string) error {
+	return &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+}
+
+func (m *memFS) Open(name string) (File, error) {
+	data, ok := m.files[name]
+	if !ok {
+		return nil, m.notExist(name)
+	}
+
+	return &memFile{name: name, Reader: bytes.NewReader(data), size: int64(len(data))}, nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	data, ok := m.files[name]
+	if !ok {
+		return nil, m.notExist(name)
+	}
+
+	return memFileInfo{name: name, size: int64(len(data))}, nil
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	data, ok := m.files[name]
+	if !ok {
+		return nil, m.notExist(name)
+	}
+
+	return data, nil
+}
+
+// Set replaces (or adds) a file's content in m. It exists for tests that
+// need to mutate config content mid-flight, such as exercising Watch.
+func (m *memFS) Set(name, content string) {
+	m.files[name] = []byte(content)
+}
+
+type memFile struct {
+	*bytes.Reader
+	name string
+	size int64
+}
+
+func (f *memFile) Close() error { return nil }
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	return memFileInfo{name: f.name, size: f.size}, nil
+}
+
+// memFileInfo is a minimal os.FileInfo for memFS entries.
+type memFileInfo struct {
+	name string
+	size int64
+}
+
+func (fi memFileInfo) Name() string       { return fi.name }
+func (fi memFileInfo) Size() int64        { return fi.size }
+func (fi memFileInfo) Mode() os.FileMode  { return 0o644 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() interface{}   { return nil }
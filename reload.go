@@ -0,0 +1,206 @@
+//
+// Copyright (c) 2019 Intel Corporation
+//
+// SPDX-License-Identifier: Apache-2.0
+//
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// watchInterval is how often Watch re-checks its inputs between ticks.
+// It's a var, not a const, so tests can shorten it instead of sleeping
+// through the production interval.
+var watchInterval = 5 * time.Second
+
+// manifestEntry records the state of one config input -- a file or an
+// environment variable -- at the time it was last loaded.
+type manifestEntry struct {
+	mtime time.Time
+	hash  [sha256.Size]byte
+}
+
+// manifest is a snapshot of every input that fed into the current
+// config, keyed by a synthetic path: real files use their path, and
+// environment variables use "env:NAME". Recomputing it and comparing
+// against the last snapshot is how Watch notices a change, rather than
+// relying solely on inotify, which misses writes through bind mounts and
+// virtio-fs.
+type manifest map[string]manifestEntry
+
+// buildManifest captures the current state of cmdlineFile, the optional
+// agent config file, and every KATA_AGENT_* environment variable.
+func (c *agentConfig) buildManifest(cmdlineFile string) manifest {
+	fs := c.fileSystem()
+	m := manifest{}
+
+	for _, path := range []string{cmdlineFile, defaultAgentConfigFile} {
+		if path == "" {
+			continue
+		}
+
+		data, err := fs.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		entry := manifestEntry{hash: sha256.Sum256(data)}
+
+		if info, err := fs.Stat(path); err == nil {
+			entry.mtime = info.ModTime()
+		}
+
+		m[path] = entry
+	}
+
+	for _, kv := range os.Environ() {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], envVarPrefix) {
+			continue
+		}
+
+		m["env:"+parts[0]] = manifestEntry{hash: sha256.Sum256([]byte(parts[1]))}
+	}
+
+	return m
+}
+
+// changed reports whether other differs from m: an input was added,
+// removed, or its (mtime, hash) pair no longer matches.
+func (m manifest) changed(other manifest) bool {
+	if len(m) != len(other) {
+		return true
+	}
+
+	for key, entry := range m {
+		o, ok := other[key]
+		if !ok || o.hash != entry.hash || !o.mtime.Equal(entry.mtime) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Watch polls cmdlineFile, the optional agent config file and the
+// process environment for changes, using a content-hash manifest rather
+// than inotify so that bind mounts and virtio-fs are covered too.
+// Whenever something that feeds the config actually changes, it
+// re-derives the config, applies only the fields that differ from the
+// live config (log level, tracing, collated trace, crash-on-error,
+// debug), and invokes onChange. A SIGHUP forces an immediate recheck.
+//
+// Watch blocks until ctx is cancelled, at which point it returns nil, or
+// until onChange returns an error, which Watch then returns.
+func (c *agentConfig) Watch(ctx context.Context, cmdlineFile string, onChange func(*agentConfig) error) error {
+	if cmdlineFile == "" {
+		return fmt.Errorf("Watch requires the kernel command line file")
+	}
+
+	current := c.buildManifest(cmdlineFile)
+
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case <-sighup:
+		}
+
+		latest := c.buildManifest(cmdlineFile)
+		if !current.changed(latest) {
+			continue
+		}
+
+		current = latest
+
+		if c.reload(cmdlineFile) {
+			if onChange == nil {
+				continue
+			}
+
+			if err := onChange(c); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// reload re-derives the config from scratch and reports whether anything
+// actually changed, so a manifest change that turns out to re-derive the
+// same effective config (e.g. a file rewritten with identical semantics
+// but different whitespace) doesn't trigger onChange.
+//
+// fresh.getConfig already applies the freshly merged config to the live,
+// package-level debug/tracing/collatedTrace/crashOnError state as a side
+// effect of calling applyConfig, which is now a total function of its
+// input (see applyConfig) and so is just as willing to lower a value as
+// to raise it. What's left here is: notice which fields actually moved
+// (for the return value), keep c.logLevel and logrus's level in sync
+// (applyConfig, run on fresh, sets only fresh.logLevel and never calls
+// logrus.SetLevel), and give a tracing backend the
+// enableTracing/disableTracing transition hooks rather than just the raw
+// booleans.
+func (c *agentConfig) reload(cmdlineFile string) bool {
+	oldLogLevel := c.logLevel
+	oldDebug, oldTracing, oldCollated, oldCrash := debug, tracing, collatedTrace, crashOnError
+
+	fresh := &agentConfig{fs: c.fs}
+	if err := fresh.getConfig(cmdlineFile); err != nil {
+		// getConfig only errors before it touches any state, so the live
+		// config is untouched; keep serving it. Watch has already recorded
+		// the new manifest, so this is retried only once an input changes
+		// again.
+		return false
+	}
+
+	changed := false
+
+	if fresh.logLevel != oldLogLevel {
+		c.logLevel = fresh.logLevel
+		logrus.SetLevel(c.logLevel)
+		changed = true
+	}
+
+	if tracing != oldTracing || collatedTrace != oldCollated {
+		if tracing || collatedTrace {
+			enableTracing(collatedTrace)
+		} else {
+			disableTracing()
+		}
+		changed = true
+	}
+
+	if crashOnError != oldCrash {
+		changed = true
+	}
+
+	if debug != oldDebug {
+		changed = true
+	}
+
+	return changed
+}
+
+func disableTracing() {
+	tracing = false
+	collatedTrace = false
+}